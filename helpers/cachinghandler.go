@@ -2,46 +2,285 @@ package helpers
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"io/fs"
 	"math/rand"
+	"strings"
+	"sync"
 
 	"github.com/willscott/go-nfs"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/google/uuid"
-	lru "github.com/hashicorp/golang-lru"
 )
 
 // NewCachingHandler wraps a handler to provide a basic to/from-file handle cache.
 func NewCachingHandler(h nfs.Handler, limit int) nfs.Handler {
-	cache, _ := lru.New(limit)
-	verifiers, _ := lru.New(limit)
+	paths := newPathTrie()
 	return &CachingHandler{
 		Handler:         h,
-		activeHandles:   cache,
-		activeVerifiers: verifiers,
+		activeHandles:   newSegmentedHandleStore(limit, pathTrieEvictor(paths)),
+		activeVerifiers: newMemoryHandleStore(limit),
 		cacheLimit:      limit,
+		paths:           paths,
 	}
 }
 
 // NewCachingHandlerWithVerifierLimit provides a basic to/from-file handle cache that can be tuned with a smaller cache of active directory listings.
 func NewCachingHandlerWithVerifierLimit(h nfs.Handler, limit int, verifierLimit int) nfs.Handler {
-	cache, _ := lru.New(limit)
-	verifiers, _ := lru.New(verifierLimit)
+	paths := newPathTrie()
+	return &CachingHandler{
+		Handler:         h,
+		activeHandles:   newSegmentedHandleStore(limit, pathTrieEvictor(paths)),
+		activeVerifiers: newMemoryHandleStore(verifierLimit),
+		cacheLimit:      limit,
+		paths:           paths,
+	}
+}
+
+// NewDeterministicHandler wraps a handler to provide a to/from-file handle
+// cache whose handles are derived deterministically from the filesystem
+// identity and path, rather than minted randomly on every ToHandle call.
+// The same path on the same filesystem therefore always resolves to the
+// same handle - but the reverse index mapping that handle back to its
+// (filesystem, path) is still only the in-memory LRU below, so it does
+// not itself survive a process restart. Pair NewDeterministicHandlerWithStore
+// with a persistent HandleStore (see NewFileHandleStore) for that.
+func NewDeterministicHandler(h nfs.Handler, limit int) nfs.Handler {
+	paths := newPathTrie()
+	return &CachingHandler{
+		Handler:         h,
+		activeHandles:   newSegmentedHandleStore(limit, pathTrieEvictor(paths)),
+		activeVerifiers: newMemoryHandleStore(limit),
+		cacheLimit:      limit,
+		deterministic:   true,
+		paths:           paths,
+	}
+}
+
+// NewDeterministicHandlerWithStore combines NewDeterministicHandler and
+// NewCachingHandlerWithStore: handles are derived deterministically from
+// the filesystem identity and path, and the reverse index mapping a
+// handle back to its (filesystem, path) is backed by the given
+// HandleStores instead of an in-memory LRU. Given a persistent handles
+// store (see NewFileHandleStore) and the same filesystems re-registered
+// with its FilesystemRegistry, handles minted before a restart resolve
+// correctly afterwards rather than failing with NFSStatusStale.
+func NewDeterministicHandlerWithStore(h nfs.Handler, limit int, handles HandleStore, verifiers HandleStore) nfs.Handler {
+	return &CachingHandler{
+		Handler:         h,
+		activeHandles:   handles,
+		activeVerifiers: verifiers,
+		cacheLimit:      limit,
+		deterministic:   true,
+		paths:           newPathTrie(),
+	}
+}
+
+// NewCachingHandlerWithStore wraps a handler with handle and verifier
+// caches backed by the given HandleStores, in place of the in-memory LRU
+// NewCachingHandler uses. Pairing this with a persistent HandleStore (see
+// NewFileHandleStore) makes handles and READDIR/READDIRPLUS verifiers
+// survive a process restart instead of turning into NFSStatusStale. The
+// ancestor-touch path trie is not wired into a caller-supplied handles
+// store's eviction, since it may not be a segmentedHandleStore; it still
+// speeds up FromHandle, just without pruning entries the store evicts on
+// its own.
+func NewCachingHandlerWithStore(h nfs.Handler, limit int, handles HandleStore, verifiers HandleStore) nfs.Handler {
 	return &CachingHandler{
 		Handler:         h,
-		activeHandles:   cache,
+		activeHandles:   handles,
 		activeVerifiers: verifiers,
 		cacheLimit:      limit,
+		paths:           newPathTrie(),
+	}
+}
+
+// NewCachingHandlerWithBus wraps a handler like NewCachingHandler, but
+// additionally subscribes to bus so that cached verifiers - and, for
+// EventRemoved/EventRenamed, the cached handles at or under the affected
+// path - are invalidated as soon as the event is published, instead of
+// only on LRU eviction. Use WatchFilesystem to feed bus from a
+// billy.Filesystem. Call Close when done with the handler to unsubscribe
+// and stop its background invalidation goroutine.
+func NewCachingHandlerWithBus(h nfs.Handler, limit int, bus Bus) nfs.Handler {
+	paths := newPathTrie()
+	c := &CachingHandler{
+		Handler:         h,
+		activeHandles:   newSegmentedHandleStore(limit, pathTrieEvictor(paths)),
+		activeVerifiers: newMemoryHandleStore(limit),
+		cacheLimit:      limit,
+		bus:             bus,
+		events:          make(chan Event, 16),
+		stop:            make(chan struct{}),
+		paths:           paths,
+	}
+	bus.Subscribe(c.events)
+	go c.watchEvents()
+	return c
+}
+
+// pathTrieEvictor returns a segmentedHandleStore eviction callback that
+// removes an id falling out of the handle cache from paths, so the trie
+// doesn't grow without bound as handles are evicted.
+func pathTrieEvictor(paths *pathTrie) func(id, value interface{}) {
+	return func(id, value interface{}) {
+		u, ok := id.(uuid.UUID)
+		if !ok {
+			return
+		}
+		e, ok := value.(entry)
+		if !ok {
+			return
+		}
+		paths.Remove(e.p, u)
+	}
+}
+
+// Notify tells the handler that path changed by op. Verifiers covering
+// path, and - for EventRemoved/EventRenamed - handles at or under path,
+// are invalidated synchronously, before Notify returns, rather than
+// waiting for LRU eviction: a READDIR served immediately after Notify
+// returns will not see the stale cached listing, and a lookup of a
+// deleted path will not keep resolving it. If the handler was also
+// constructed with a Bus, the event is additionally published for any
+// other subscribers; that fan-out is asynchronous, but it cannot make
+// this handler's own invalidation late. Notify has no parameter for
+// OldPath, so Notify(path, EventRenamed) only ever invalidates the new
+// path; call NotifyRename instead when the old path is known.
+func (c *CachingHandler) Notify(path []string, op EventOp) {
+	c.invalidatePath(path, op)
+	c.busMu.Lock()
+	bus := c.bus
+	c.busMu.Unlock()
+	if bus != nil {
+		bus.Publish(Event{Op: op, Path: path})
+	}
+}
+
+// NotifyRename tells the handler that the entry at oldPath now lives at
+// path. Unlike Notify(path, EventRenamed), it also invalidates verifiers
+// and handles under oldPath, and - if the handler was constructed with a
+// Bus - publishes an EventRenamed event carrying OldPath, so other
+// subscribers' rename handling in watchEvents fires too.
+func (c *CachingHandler) NotifyRename(oldPath, path []string) {
+	c.invalidatePath(oldPath, EventRemoved)
+	c.invalidatePath(path, EventRenamed)
+	c.busMu.Lock()
+	bus := c.bus
+	c.busMu.Unlock()
+	if bus != nil {
+		bus.Publish(Event{Op: EventRenamed, Path: path, OldPath: oldPath})
+	}
+}
+
+// Close unsubscribes the handler from its Bus, if any, and stops its
+// background invalidation goroutine. It is a no-op if the handler was not
+// constructed with NewCachingHandlerWithBus. Close does not close the
+// events channel itself, since a Publish already in flight could still
+// attempt to send to it; the channel is simply abandoned and left for the
+// garbage collector once the background goroutine has returned.
+func (c *CachingHandler) Close() error {
+	c.busMu.Lock()
+	bus := c.bus
+	c.bus = nil
+	c.busMu.Unlock()
+	if bus == nil {
+		return nil
+	}
+	bus.Unsubscribe(c.events)
+	close(c.stop)
+	return nil
+}
+
+func (c *CachingHandler) watchEvents() {
+	for {
+		select {
+		case ev := <-c.events:
+			c.invalidatePath(ev.Path, ev.Op)
+			// An EventRenamed without OldPath (e.g. from Notify) has no old
+			// location to invalidate; an empty path would match everything.
+			if ev.Op == EventRenamed && len(ev.OldPath) > 0 {
+				c.invalidatePath(ev.OldPath, EventRemoved)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// invalidatePath removes every cached verifier whose handle resolves to a
+// path that is a prefix of, or prefixed by, path - i.e. anything whose
+// listing could have been affected by a change at path - and, for an op
+// that means path itself is gone (EventRemoved, EventRenamed), also
+// removes every cached handle at or under path, so FromHandle reports
+// NFSStatusStale for it instead of continuing to resolve it.
+func (c *CachingHandler) invalidatePath(path []string, op EventOp) {
+	for _, k := range c.activeVerifiers.Keys() {
+		v, ok := c.activeVerifiers.Peek(k)
+		if !ok {
+			continue
+		}
+		ver := v.(verifier)
+		_, p, err := c.FromHandle(ver.handle)
+		if err != nil {
+			continue
+		}
+		if hasPrefix(path, p) || hasPrefix(p, path) {
+			c.activeVerifiers.Delete(k)
+		}
+	}
+	if (op != EventRemoved && op != EventRenamed) || c.paths == nil {
+		return
+	}
+	for _, id := range c.paths.RemoveSubtree(path) {
+		c.activeHandles.Delete(id)
 	}
 }
 
-// CachingHandler implements to/from handle via an LRU cache.
+// FilesystemIdentifier is an optional interface a billy.Filesystem can
+// implement to provide a stable identity to seed deterministic handles,
+// e.g. a device+inode namespace, a git repository OID, or an S3 bucket
+// ARN. Filesystems that don't implement it fall back to their Root path,
+// which is stable for a given mount but may collide across distinct
+// billy.Filesystem implementations rooted at the same path.
+type FilesystemIdentifier interface {
+	// FilesystemID returns a byte string that uniquely and stably
+	// identifies this filesystem.
+	FilesystemID() []byte
+}
+
+// HandleForFunc derives a handle for a path within a filesystem. Setting
+// CachingHandler.HandleFor overrides the default digest derivation used by
+// a deterministic handler, letting callers that already track a stable
+// identity for a file (device+inode, blob OID, ETag, ...) supply the
+// handle directly instead of having one computed from the path.
+type HandleForFunc func(f billy.Filesystem, path []string) []byte
+
+// CachingHandler implements to/from handle via a HandleStore, which
+// defaults to an in-memory LRU cache but can be swapped for a persistent
+// implementation.
 type CachingHandler struct {
 	nfs.Handler
-	activeHandles   *lru.Cache
-	activeVerifiers *lru.Cache
+	activeHandles   HandleStore
+	activeVerifiers HandleStore
 	cacheLimit      int
+	deterministic   bool
+	// busMu guards bus: Notify reads it and Close clears it, and both can
+	// be called concurrently once a handler is wired into a running
+	// server, so plain field access would race.
+	busMu  sync.Mutex
+	bus    Bus
+	events chan Event
+	stop   chan struct{}
+	// paths indexes live handle IDs by path, so FromHandle can find the
+	// handles covering an ancestor directory without scanning every live
+	// handle. It is nil unless populated by one of the New* constructors.
+	paths *pathTrie
+
+	// HandleFor, if set, overrides the default digest derivation used by a
+	// deterministic handler to compute the handle for a path.
+	HandleFor HandleForFunc
 }
 
 type entry struct {
@@ -53,10 +292,53 @@ type entry struct {
 // In stateless nfs (when it's serving a unix fs) this can be the device + inode
 // but we can generalize with a stateful local cache of handed out IDs.
 func (c *CachingHandler) ToHandle(f billy.Filesystem, path []string) []byte {
-	id := uuid.New()
-	c.activeHandles.Add(id, entry{f, path})
-	b, _ := id.MarshalBinary()
-	return b
+	if !c.deterministic {
+		id := uuid.New()
+		c.activeHandles.Put(id, entry{f, path})
+		c.indexPath(path, id)
+		b, _ := id.MarshalBinary()
+		return b
+	}
+
+	var digest []byte
+	if c.HandleFor != nil {
+		digest = c.HandleFor(f, path)
+	} else {
+		digest = defaultHandleFor(f, path)
+	}
+	var id uuid.UUID
+	copy(id[:], digest)
+	c.activeHandles.Put(id, entry{f, path})
+	c.indexPath(path, id)
+	return id[:]
+}
+
+// indexPath records id in the path trie, if this handler was constructed
+// with one.
+func (c *CachingHandler) indexPath(path []string, id uuid.UUID) {
+	if c.paths != nil {
+		c.paths.Insert(path, id)
+	}
+}
+
+// defaultHandleFor derives a stable handle for path by hashing the
+// filesystem's identity together with the path components, truncated to
+// the 16 bytes a handle requires.
+func defaultHandleFor(f billy.Filesystem, path []string) []byte {
+	h := sha256.New()
+	h.Write(filesystemID(f))
+	h.Write([]byte{0x00})
+	h.Write([]byte(strings.Join(path, "/")))
+	return h.Sum(nil)[:16]
+}
+
+// filesystemID returns the stable identity used to namespace handles for f,
+// preferring FilesystemID when f implements it.
+func filesystemID(f billy.Filesystem) []byte {
+	if idf, ok := f.(FilesystemIdentifier); ok {
+		return idf.FilesystemID()
+	}
+	return []byte(f.Root())
 }
 
 // FromHandle converts from an opaque handle to the file it represents
@@ -68,11 +350,16 @@ func (c *CachingHandler) FromHandle(fh []byte) (billy.Filesystem, []string, erro
 
 	if cache, ok := c.activeHandles.Get(id); ok {
 		f, ok := cache.(entry)
-		for _, k := range c.activeHandles.Keys() {
-			e, _ := c.activeHandles.Peek(k)
-			candidate := e.(entry)
-			if hasPrefix(f.p, candidate.p) {
-				_, _ = c.activeHandles.Get(k)
+		if ok && c.paths != nil {
+			// Re-touch every live handle that is an ancestor of this one,
+			// so a lookup of a deep path also keeps its parent
+			// directories' handles hot in the segmented LRU - without
+			// scanning every live handle to find them.
+			for _, ancestor := range c.paths.Ancestors(f.p) {
+				if ancestor == id {
+					continue
+				}
+				c.activeHandles.Get(ancestor)
 			}
 		}
 		if ok {
@@ -106,7 +393,7 @@ type verifier struct {
 
 func (c *CachingHandler) VerifierFor(handle []byte, contents []fs.FileInfo) uint64 {
 	id := rand.Uint64()
-	c.activeVerifiers.Add(id, verifier{handle, contents})
+	c.activeVerifiers.Put(id, verifier{handle, contents})
 	return id
 }
 
@@ -0,0 +1,84 @@
+package helpers
+
+import (
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+)
+
+// TestNotifyInvalidatesVerifier asserts a verifier covering a path is
+// gone from the cache as soon as Notify returns for that path, rather
+// than only once it's evicted by the LRU.
+func TestNotifyInvalidatesVerifier(t *testing.T) {
+	h := NewCachingHandler(nil, 16)
+	ch := h.(*CachingHandler)
+	fs := memfs.New()
+
+	handle := ch.ToHandle(fs, []string{"dir"})
+	id := ch.VerifierFor(handle, nil)
+
+	ch.Notify([]string{"dir"}, EventModified)
+
+	if got := ch.DataForVerifier(handle, id); got != nil {
+		t.Fatalf("DataForVerifier after Notify = %v, want nil (invalidated)", got)
+	}
+}
+
+// TestNotifyRemovedInvalidatesHandle asserts FromHandle reports
+// NFSStatusStale for a path after Notify(path, EventRemoved), instead of
+// continuing to resolve a handle minted before the removal.
+func TestNotifyRemovedInvalidatesHandle(t *testing.T) {
+	h := NewCachingHandler(nil, 16)
+	ch := h.(*CachingHandler)
+	fs := memfs.New()
+
+	handle := ch.ToHandle(fs, []string{"dir", "file"})
+	if _, _, err := ch.FromHandle(handle); err != nil {
+		t.Fatalf("FromHandle before Notify: %v", err)
+	}
+
+	ch.Notify([]string{"dir", "file"}, EventRemoved)
+
+	if _, _, err := ch.FromHandle(handle); err == nil {
+		t.Fatalf("FromHandle after Notify(EventRemoved): got no error, want NFSStatusStale")
+	}
+}
+
+// TestNotifyRemovedInvalidatesDescendantHandles asserts removing a
+// directory also invalidates handles minted for entries nested under it,
+// not just the directory's own handle.
+func TestNotifyRemovedInvalidatesDescendantHandles(t *testing.T) {
+	h := NewCachingHandler(nil, 16)
+	ch := h.(*CachingHandler)
+	fs := memfs.New()
+
+	child := ch.ToHandle(fs, []string{"dir", "child"})
+
+	ch.Notify([]string{"dir"}, EventRemoved)
+
+	if _, _, err := ch.FromHandle(child); err == nil {
+		t.Fatalf("FromHandle(child) after removing its parent: got no error, want NFSStatusStale")
+	}
+}
+
+// TestNotifyRenameInvalidatesOldPath asserts NotifyRename invalidates a
+// verifier cached for the path an entry is renamed away from, which
+// Notify(path, EventRenamed) cannot do since it has no OldPath
+// parameter.
+func TestNotifyRenameInvalidatesOldPath(t *testing.T) {
+	h := NewCachingHandler(nil, 16)
+	ch := h.(*CachingHandler)
+	fs := memfs.New()
+
+	oldHandle := ch.ToHandle(fs, []string{"old"})
+	id := ch.VerifierFor(oldHandle, nil)
+
+	ch.NotifyRename([]string{"old"}, []string{"new"})
+
+	if got := ch.DataForVerifier(oldHandle, id); got != nil {
+		t.Fatalf("DataForVerifier(oldHandle) after NotifyRename = %v, want nil (invalidated)", got)
+	}
+	if _, _, err := ch.FromHandle(oldHandle); err == nil {
+		t.Fatalf("FromHandle(oldHandle) after NotifyRename: got no error, want NFSStatusStale")
+	}
+}
@@ -0,0 +1,40 @@
+package helpers
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+)
+
+// TestDeterministicHandleStable asserts the property NewDeterministicHandler
+// promises in its doc comment: ToHandle for the same (filesystem, path) pair
+// returns the same handle every time, even across intervening calls for
+// other paths that could otherwise perturb the cache.
+func TestDeterministicHandleStable(t *testing.T) {
+	h := NewDeterministicHandler(nil, 16)
+	fs := memfs.New()
+
+	first := h.ToHandle(fs, []string{"a", "b"})
+	h.ToHandle(fs, []string{"c"})
+	h.ToHandle(fs, []string{"d", "e", "f"})
+	second := h.ToHandle(fs, []string{"a", "b"})
+
+	if !bytes.Equal(first, second) {
+		t.Fatalf("ToHandle(a/b) = %x then %x, want the same handle both times", first, second)
+	}
+}
+
+// TestDeterministicHandleDistinctPaths asserts distinct paths on the same
+// filesystem get distinct handles.
+func TestDeterministicHandleDistinctPaths(t *testing.T) {
+	h := NewDeterministicHandler(nil, 16)
+	fs := memfs.New()
+
+	a := h.ToHandle(fs, []string{"a"})
+	b := h.ToHandle(fs, []string{"b"})
+
+	if bytes.Equal(a, b) {
+		t.Fatalf("ToHandle(a) and ToHandle(b) both returned %x, want distinct handles", a)
+	}
+}
@@ -0,0 +1,136 @@
+package helpers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// EventOp identifies the kind of change that occurred to a path.
+type EventOp int
+
+const (
+	// EventCreated indicates a new file or directory appeared at Path.
+	EventCreated EventOp = iota
+	// EventRemoved indicates the file or directory at Path is gone.
+	EventRemoved
+	// EventRenamed indicates the entry at OldPath now lives at Path.
+	EventRenamed
+	// EventModified indicates the contents of Path changed in place.
+	EventModified
+)
+
+// Event describes a single out-of-band change to a billy.Filesystem.
+type Event struct {
+	Op   EventOp
+	Path []string
+	// OldPath is set only for EventRenamed, and holds the path the entry
+	// was renamed from.
+	OldPath []string
+}
+
+// Bus is a small pub/sub fan-out for filesystem change Events. A
+// CachingHandler subscribes to invalidate cached verifiers whose listing
+// may have gone stale; custom billy.Filesystem implementations that learn
+// about out-of-band changes (a fuse mount, an fsnotify watch, a webhook
+// from an S3 bucket) publish to it via Notify.
+type Bus interface {
+	// Publish fans ev out to every subscriber. It does not block on slow
+	// subscribers; see NewBus.
+	Publish(ev Event)
+	// Subscribe registers ch to receive every future Publish.
+	Subscribe(ch chan Event)
+	// Unsubscribe stops ch from receiving further events.
+	Unsubscribe(ch chan Event)
+}
+
+// memoryBus is the default Bus: an in-process fan-out over channels.
+type memoryBus struct {
+	mu   sync.RWMutex
+	subs map[chan Event]struct{}
+}
+
+// NewBus returns an in-process Bus. Publish sends to each subscriber in
+// its own goroutine, so a slow or blocked subscriber cannot stall
+// publishers.
+func NewBus() Bus {
+	return &memoryBus{subs: make(map[chan Event]struct{})}
+}
+
+func (b *memoryBus) Publish(ev Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for ch := range b.subs {
+		go func(ch chan Event) { ch <- ev }(ch)
+	}
+}
+
+func (b *memoryBus) Subscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[ch] = struct{}{}
+}
+
+func (b *memoryBus) Unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, ch)
+}
+
+// Watcher is implemented by billy.Filesystem values that can report their
+// own changes without being polled, e.g. by wrapping a fuse mount or an
+// fsnotify watch. WatchFilesystem prefers this over polling when present.
+type Watcher interface {
+	// Watch begins publishing this filesystem's changes to bus. It
+	// should return once watching has started; publishing continues in
+	// the background until the filesystem is discarded.
+	Watch(bus Bus) error
+}
+
+// WatchFilesystem starts forwarding f's changes to bus, using f's own
+// Watcher implementation if it has one, or else polling f from its root on
+// the given interval. The poller is a best-effort fallback: it compares
+// each directory's number of entries with the count from the previous
+// poll, only for directories it has previously listed, and reports a
+// difference as EventModified without distinguishing
+// create/remove/rename. A change that leaves a directory's entry count
+// the same, such as a rename within it or a file modified in place, is
+// not reported.
+func WatchFilesystem(f billy.Filesystem, bus Bus, pollInterval time.Duration) error {
+	if w, ok := f.(Watcher); ok {
+		return w.Watch(bus)
+	}
+	go pollFilesystem(f, bus, pollInterval)
+	return nil
+}
+
+// pollFilesystem periodically re-lists f's directories and publishes an
+// EventModified for any directory whose number of entries changed since
+// the previous poll.
+func pollFilesystem(f billy.Filesystem, bus Bus, interval time.Duration) {
+	seen := make(map[string]int)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		pollDir(f, nil, seen, bus)
+	}
+}
+
+func pollDir(f billy.Filesystem, path []string, seen map[string]int, bus Bus) {
+	dir := f.Join(path...)
+	infos, err := f.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	key := dir
+	if prev, ok := seen[key]; ok && prev != len(infos) {
+		bus.Publish(Event{Op: EventModified, Path: path})
+	}
+	seen[key] = len(infos)
+	for _, info := range infos {
+		if info.IsDir() {
+			pollDir(f, append(append([]string{}, path...), info.Name()), seen, bus)
+		}
+	}
+}
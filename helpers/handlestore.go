@@ -0,0 +1,567 @@
+package helpers
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/google/uuid"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// HandleStore abstracts the storage backing a CachingHandler's handle and
+// verifier caches, so the in-memory LRU used by NewCachingHandler can be
+// swapped for a persistent implementation (see NewFileHandleStore)
+// without changing CachingHandler itself.
+type HandleStore interface {
+	// Put records value under id, evicting an older entry if the store is
+	// at capacity.
+	Put(id interface{}, value interface{})
+	// Get retrieves the value stored under id, if any, refreshing its
+	// recency for stores that track one.
+	Get(id interface{}) (interface{}, bool)
+	// Peek retrieves the value stored under id, if any, without affecting
+	// recency.
+	Peek(id interface{}) (interface{}, bool)
+	// Delete removes the entry stored under id, if any.
+	Delete(id interface{})
+	// Keys returns every id currently stored.
+	Keys() []interface{}
+}
+
+// memoryHandleStore is the default HandleStore, backed by an in-memory LRU
+// cache. It provides no durability: a process restart loses every handle,
+// which is the behavior NewCachingHandler has always had.
+type memoryHandleStore struct {
+	cache *lru.Cache
+}
+
+func newMemoryHandleStore(limit int) HandleStore {
+	cache, _ := lru.New(limit)
+	return &memoryHandleStore{cache: cache}
+}
+
+func (m *memoryHandleStore) Put(id, value interface{}) { m.cache.Add(id, value) }
+func (m *memoryHandleStore) Get(id interface{}) (interface{}, bool) { return m.cache.Get(id) }
+func (m *memoryHandleStore) Peek(id interface{}) (interface{}, bool) { return m.cache.Peek(id) }
+func (m *memoryHandleStore) Delete(id interface{}) { m.cache.Remove(id) }
+func (m *memoryHandleStore) Keys() []interface{} { return m.cache.Keys() }
+
+// segmentedHandleStore is a two-tier LRU: a small "hot" cache of recently
+// touched entries backed by a larger "cold" cache of everything else.
+// Get promotes an entry from cold to hot, so that repeatedly touching a
+// whole subtree of ancestor handles (see pathTrie) only contends the hot
+// cache's LRU order, instead of evicting unrelated entries that happen to
+// sit at the end of a single shared LRU.
+type segmentedHandleStore struct {
+	mu       sync.Mutex
+	hot      *lru.Cache
+	cold     *lru.Cache
+	onEvict  func(id, value interface{})
+	suppress bool
+}
+
+// newSegmentedHandleStore returns a segmented LRU of the given total
+// capacity. onEvict, if non-nil, is called once for an id that falls out
+// of the store entirely - i.e. evicted from cold, not merely demoted from
+// hot back to cold - so callers can keep a side index (such as a
+// pathTrie) in sync with what the store actually still holds.
+func newSegmentedHandleStore(limit int, onEvict func(id, value interface{})) HandleStore {
+	hotLimit := limit / 4
+	if hotLimit < 1 {
+		hotLimit = 1
+	}
+	coldLimit := limit - hotLimit
+	if coldLimit < 1 {
+		coldLimit = 1
+	}
+	s := &segmentedHandleStore{onEvict: onEvict}
+	s.hot, _ = lru.NewWithEvict(hotLimit, func(key, value interface{}) {
+		if s.suppress {
+			return
+		}
+		// The hot cache is full: demote the evicted entry back to cold
+		// instead of dropping it.
+		s.cold.Add(key, value)
+	})
+	s.cold, _ = lru.NewWithEvict(coldLimit, func(key, value interface{}) {
+		if s.suppress || s.onEvict == nil {
+			return
+		}
+		s.onEvict(key, value)
+	})
+	return s
+}
+
+func (s *segmentedHandleStore) Put(id, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// If id is already hot (the common case for a deterministic handler,
+	// which recomputes the same id on every repeat lookup of a path),
+	// update it in place rather than also writing a second, stale copy
+	// into cold.
+	if _, ok := s.hot.Peek(id); ok {
+		s.hot.Add(id, value)
+		return
+	}
+	s.cold.Add(id, value)
+}
+
+func (s *segmentedHandleStore) Get(id interface{}) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.hot.Peek(id); ok {
+		s.hot.Get(id)
+		return v, true
+	}
+	if v, ok := s.cold.Peek(id); ok {
+		// Moving an entry from cold to hot is a promotion, not an
+		// eviction - suppress the cold callback for it.
+		s.suppress = true
+		s.cold.Remove(id)
+		s.suppress = false
+		s.hot.Add(id, v)
+		return v, true
+	}
+	return nil, false
+}
+
+func (s *segmentedHandleStore) Peek(id interface{}) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.hot.Peek(id); ok {
+		return v, true
+	}
+	return s.cold.Peek(id)
+}
+
+func (s *segmentedHandleStore) Delete(id interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hotValue, inHot := s.hot.Peek(id)
+	coldValue, inCold := s.cold.Peek(id)
+	// This is a real delete, not a capacity eviction: suppress hot's
+	// automatic demote-to-cold and cold's automatic onEvict, then call
+	// onEvict ourselves exactly once below.
+	s.suppress = true
+	s.hot.Remove(id)
+	s.cold.Remove(id)
+	s.suppress = false
+	if s.onEvict == nil {
+		return
+	}
+	if inHot {
+		s.onEvict(id, hotValue)
+	} else if inCold {
+		s.onEvict(id, coldValue)
+	}
+}
+
+func (s *segmentedHandleStore) Keys() []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append(s.hot.Keys(), s.cold.Keys()...)
+}
+
+// FilesystemRegistry resolves the stable identity produced by
+// filesystemID back to a billy.Filesystem, so a persistent HandleStore -
+// which can only serialize that identity, not the billy.Filesystem value
+// itself - can rehydrate the filesystem a stored handle refers to after a
+// restart. Register every filesystem a persistent store's handles may
+// reference before reading handles back from it.
+type FilesystemRegistry struct {
+	mu   sync.RWMutex
+	byID map[string]billy.Filesystem
+}
+
+// NewFilesystemRegistry returns an empty FilesystemRegistry.
+func NewFilesystemRegistry() *FilesystemRegistry {
+	return &FilesystemRegistry{byID: make(map[string]billy.Filesystem)}
+}
+
+// Register associates f with its filesystemID, so EntryCodec can look it
+// up again when decoding a persisted handle.
+func (r *FilesystemRegistry) Register(f billy.Filesystem) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byID[string(filesystemID(f))] = f
+}
+
+func (r *FilesystemRegistry) lookup(id []byte) (billy.Filesystem, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	f, ok := r.byID[string(id)]
+	return f, ok
+}
+
+// Codec encodes and decodes the ids and values a particular HandleStore
+// instance holds, so FileHandleStore can persist both the opaque file
+// handle cache (entry values, uuid.UUID ids) and the directory verifier
+// cache (verifier values, uint64 ids) through the same log format.
+type Codec interface {
+	EncodeID(id interface{}) ([]byte, error)
+	DecodeID(b []byte) (interface{}, error)
+	EncodeValue(value interface{}) ([]byte, error)
+	DecodeValue(b []byte) (interface{}, error)
+}
+
+// EntryCodec is the Codec for a CachingHandler's handle cache. It
+// persists the (filesystem, path) pair behind each handle by recording
+// the filesystem's stable identity and resolving it back through a
+// FilesystemRegistry on decode.
+type EntryCodec struct {
+	Registry *FilesystemRegistry
+}
+
+type entryRecord struct {
+	FilesystemID []byte   `json:"fs"`
+	Path         []string `json:"path"`
+}
+
+// EncodeID implements Codec.
+func (EntryCodec) EncodeID(id interface{}) ([]byte, error) {
+	u, ok := id.(uuid.UUID)
+	if !ok {
+		return nil, fmt.Errorf("helpers: expected uuid.UUID id, got %T", id)
+	}
+	return u[:], nil
+}
+
+// DecodeID implements Codec.
+func (EntryCodec) DecodeID(b []byte) (interface{}, error) {
+	return uuid.FromBytes(b)
+}
+
+// EncodeValue implements Codec.
+func (c EntryCodec) EncodeValue(value interface{}) ([]byte, error) {
+	e, ok := value.(entry)
+	if !ok {
+		return nil, fmt.Errorf("helpers: expected entry value, got %T", value)
+	}
+	return json.Marshal(entryRecord{FilesystemID: filesystemID(e.f), Path: e.p})
+}
+
+// DecodeValue implements Codec.
+func (c EntryCodec) DecodeValue(b []byte) (interface{}, error) {
+	var rec entryRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, err
+	}
+	f, ok := c.Registry.lookup(rec.FilesystemID)
+	if !ok {
+		return nil, fmt.Errorf("helpers: filesystem %x is not registered", rec.FilesystemID)
+	}
+	return entry{f, rec.Path}, nil
+}
+
+// VerifierCodec is the Codec for a CachingHandler's directory verifier
+// cache. It persists enough of each fs.FileInfo to reconstruct a
+// READDIR/READDIRPLUS listing without needing the original filesystem's
+// live FileInfo implementation.
+type VerifierCodec struct{}
+
+type verifierRecord struct {
+	Handle   []byte           `json:"handle"`
+	Contents []fileInfoRecord `json:"contents"`
+}
+
+type fileInfoRecord struct {
+	Name    string      `json:"name"`
+	Size    int64       `json:"size"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime int64       `json:"mod_time"`
+	IsDir   bool        `json:"is_dir"`
+}
+
+// EncodeID implements Codec.
+func (VerifierCodec) EncodeID(id interface{}) ([]byte, error) {
+	u, ok := id.(uint64)
+	if !ok {
+		return nil, fmt.Errorf("helpers: expected uint64 id, got %T", id)
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, u)
+	return b, nil
+}
+
+// DecodeID implements Codec.
+func (VerifierCodec) DecodeID(b []byte) (interface{}, error) {
+	if len(b) != 8 {
+		return nil, fmt.Errorf("helpers: malformed verifier id %x", b)
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// EncodeValue implements Codec.
+func (VerifierCodec) EncodeValue(value interface{}) ([]byte, error) {
+	v, ok := value.(verifier)
+	if !ok {
+		return nil, fmt.Errorf("helpers: expected verifier value, got %T", value)
+	}
+	rec := verifierRecord{Handle: v.handle}
+	for _, fi := range v.contents {
+		rec.Contents = append(rec.Contents, fileInfoRecord{
+			Name:    fi.Name(),
+			Size:    fi.Size(),
+			Mode:    fi.Mode(),
+			ModTime: fi.ModTime().UnixNano(),
+			IsDir:   fi.IsDir(),
+		})
+	}
+	return json.Marshal(rec)
+}
+
+// DecodeValue implements Codec.
+func (VerifierCodec) DecodeValue(b []byte) (interface{}, error) {
+	var rec verifierRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, err
+	}
+	v := verifier{handle: rec.Handle}
+	for _, fir := range rec.Contents {
+		v.contents = append(v.contents, staticFileInfo{
+			name:    fir.Name,
+			size:    fir.Size,
+			mode:    fir.Mode,
+			modTime: time.Unix(0, fir.ModTime),
+			isDir:   fir.IsDir,
+		})
+	}
+	return v, nil
+}
+
+// staticFileInfo is an fs.FileInfo snapshot reconstructed from a
+// persisted verifier record, since the original filesystem's live
+// FileInfo implementation isn't available after a restart.
+type staticFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	isDir   bool
+}
+
+func (s staticFileInfo) Name() string       { return s.name }
+func (s staticFileInfo) Size() int64        { return s.size }
+func (s staticFileInfo) Mode() fs.FileMode  { return s.mode }
+func (s staticFileInfo) ModTime() time.Time { return s.modTime }
+func (s staticFileInfo) IsDir() bool        { return s.isDir }
+func (s staticFileInfo) Sys() interface{}   { return nil }
+
+// FileHandleStore is a disk-backed HandleStore implemented as an
+// append-only log plus an in-memory index of the latest record per id,
+// rebuilt by replaying the log on open. Peek is an O(1) index lookup;
+// Get, Put and Delete also update the recency order, which is a linear
+// scan over the live keys. Startup pays for replaying the whole log.
+type FileHandleStore struct {
+	mu    sync.Mutex
+	file  *os.File
+	codec Codec
+	index map[string]interface{}
+	// order holds live keys least-recently-used-first: Put appends a new
+	// key to the back, and Get moves an existing key to the back, so
+	// evictOverLimit can evict the least-recently-used entry once limit
+	// is exceeded. limit <= 0 means unbounded.
+	order []string
+	limit int
+}
+
+// NewFileHandleStore opens (creating if necessary) the append-only log at
+// path, replays it to rebuild the in-memory index, and returns a
+// HandleStore ready to back a CachingHandler via
+// NewCachingHandlerWithStore. Once more than limit entries are live, Put
+// evicts the least-recently-used entry first; pass limit <= 0 for no cap.
+func NewFileHandleStore(path string, codec Codec, limit int) (*FileHandleStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileHandleStore{file: f, codec: codec, index: make(map[string]interface{}), limit: limit}
+	if err := s.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.evictOverLimit()
+	return s, nil
+}
+
+type logRecord struct {
+	ID      []byte `json:"id"`
+	Value   []byte `json:"value,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+func (s *FileHandleStore) replay() error {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bufio.NewReader(s.file))
+	for {
+		var rec logRecord
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		key := string(rec.ID)
+		if rec.Deleted {
+			delete(s.index, key)
+			s.removeOrder(key)
+			continue
+		}
+		value, err := s.codec.DecodeValue(rec.Value)
+		if err != nil {
+			// The filesystem this record refers to may no longer be
+			// registered; let it miss on lookup like an evicted entry
+			// would, rather than failing the whole replay.
+			continue
+		}
+		if _, exists := s.index[key]; !exists {
+			s.order = append(s.order, key)
+		}
+		s.index[key] = value
+	}
+	_, err := s.file.Seek(0, io.SeekEnd)
+	return err
+}
+
+// removeOrder drops key from the recency order, if present.
+func (s *FileHandleStore) removeOrder(key string) {
+	for i, k := range s.order {
+		if k == key {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// evictOverLimit evicts the least-recently-used live entries until the
+// store is back at or under limit.
+func (s *FileHandleStore) evictOverLimit() {
+	if s.limit <= 0 {
+		return
+	}
+	for len(s.order) > s.limit {
+		oldest := s.order[0]
+		s.order = s.order[1:]
+		if _, ok := s.index[oldest]; !ok {
+			continue
+		}
+		delete(s.index, oldest)
+		_ = s.append(logRecord{ID: []byte(oldest), Deleted: true})
+	}
+}
+
+func (s *FileHandleStore) append(rec logRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = s.file.Write(b)
+	return err
+}
+
+// Put implements HandleStore.
+func (s *FileHandleStore) Put(id, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idb, err := s.codec.EncodeID(id)
+	if err != nil {
+		return
+	}
+	valb, err := s.codec.EncodeValue(value)
+	if err != nil {
+		return
+	}
+	if err := s.append(logRecord{ID: idb, Value: valb}); err != nil {
+		return
+	}
+	key := string(idb)
+	s.touchOrder(key)
+	s.index[key] = value
+	s.evictOverLimit()
+}
+
+// Get implements HandleStore. Unlike Peek, it refreshes id's recency, so
+// evictOverLimit evicts least-recently-used rather than oldest-inserted.
+func (s *FileHandleStore) Get(id interface{}) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idb, err := s.codec.EncodeID(id)
+	if err != nil {
+		return nil, false
+	}
+	key := string(idb)
+	v, ok := s.index[key]
+	if ok {
+		s.touchOrder(key)
+	}
+	return v, ok
+}
+
+// Peek implements HandleStore.
+func (s *FileHandleStore) Peek(id interface{}) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idb, err := s.codec.EncodeID(id)
+	if err != nil {
+		return nil, false
+	}
+	v, ok := s.index[string(idb)]
+	return v, ok
+}
+
+// touchOrder moves key to the back of the recency order, marking it most
+// recently used.
+func (s *FileHandleStore) touchOrder(key string) {
+	s.removeOrder(key)
+	s.order = append(s.order, key)
+}
+
+// Delete implements HandleStore.
+func (s *FileHandleStore) Delete(id interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idb, err := s.codec.EncodeID(id)
+	if err != nil {
+		return
+	}
+	_ = s.append(logRecord{ID: idb, Deleted: true})
+	delete(s.index, string(idb))
+	s.removeOrder(string(idb))
+}
+
+// Keys implements HandleStore.
+func (s *FileHandleStore) Keys() []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]interface{}, 0, len(s.index))
+	for k := range s.index {
+		id, err := s.codec.DecodeID([]byte(k))
+		if err != nil {
+			continue
+		}
+		keys = append(keys, id)
+	}
+	return keys
+}
+
+// Close flushes and closes the underlying log file.
+func (s *FileHandleStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
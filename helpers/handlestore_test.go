@@ -0,0 +1,112 @@
+package helpers
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestSegmentedHandleStoreCapacity asserts the total live-entry count a
+// segmentedHandleStore holds never exceeds the limit it was constructed
+// with, across both its hot and cold tiers combined - the bug fixed by
+// sizing cold to limit-hotLimit instead of limit.
+func TestSegmentedHandleStoreCapacity(t *testing.T) {
+	const limit = 20
+	s := newSegmentedHandleStore(limit, nil)
+	for i := 0; i < limit*5; i++ {
+		s.Put(i, i)
+		s.Get(i) // promote, so the hot tier fills as well as cold
+	}
+	if got := len(s.Keys()); got > limit {
+		t.Fatalf("segmentedHandleStore holds %d entries, want <= %d", got, limit)
+	}
+}
+
+// TestSegmentedHandleStoreNoDuplicatePut asserts repeatedly Put-ing the
+// same id that is already hot updates it in place instead of also
+// leaving a second, stale copy in cold - the bug fixed by checking
+// hot.Peek before writing cold.
+func TestSegmentedHandleStoreNoDuplicatePut(t *testing.T) {
+	s := newSegmentedHandleStore(20, nil)
+	s.Put("id", "first")
+	s.Get("id") // promote to hot
+	s.Put("id", "second")
+
+	v, ok := s.Peek("id")
+	if !ok || v != "second" {
+		t.Fatalf("Peek(id) = (%v, %v), want (second, true)", v, ok)
+	}
+	keys := s.Keys()
+	count := 0
+	for _, k := range keys {
+		if k == "id" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Fatalf("id appears %d times across hot+cold Keys(), want exactly 1", count)
+	}
+}
+
+// TestFileHandleStoreRestartRoundTrip asserts a FileHandleStore reopened
+// against the same log file recovers every entry that was Put and not
+// later Delete'd, which is the whole reason FileHandleStore exists:
+// handles and verifiers surviving a process restart.
+func TestFileHandleStoreRestartRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handles.log")
+
+	s, err := NewFileHandleStore(path, VerifierCodec{}, 0)
+	if err != nil {
+		t.Fatalf("NewFileHandleStore: %v", err)
+	}
+	s.Put(uint64(1), verifier{handle: []byte("a")})
+	s.Put(uint64(2), verifier{handle: []byte("b")})
+	s.Delete(uint64(2))
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	reopened, err := NewFileHandleStore(path, VerifierCodec{}, 0)
+	if err != nil {
+		t.Fatalf("NewFileHandleStore (reopen): %v", err)
+	}
+	defer reopened.Close()
+
+	v, ok := reopened.Get(uint64(1))
+	if !ok {
+		t.Fatalf("Get(1) after restart: not found, want the entry Put before restart")
+	}
+	if got := v.(verifier).handle; string(got) != "a" {
+		t.Fatalf("Get(1) after restart = %q, want %q", got, "a")
+	}
+	if _, ok := reopened.Get(uint64(2)); ok {
+		t.Fatalf("Get(2) after restart: found, want it gone since it was Delete'd before restart")
+	}
+}
+
+// TestFileHandleStoreEvictsLeastRecentlyUsed asserts Get refreshes an
+// entry's recency, so a heavily-read entry survives capacity eviction
+// even though it was the oldest inserted - the FIFO-not-LRU bug fixed by
+// making Get call touchOrder instead of only Peek.
+func TestFileHandleStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handles.log")
+	s, err := NewFileHandleStore(path, VerifierCodec{}, 2)
+	if err != nil {
+		t.Fatalf("NewFileHandleStore: %v", err)
+	}
+	defer s.Close()
+
+	s.Put(uint64(1), verifier{handle: []byte("root")})
+	s.Put(uint64(2), verifier{handle: []byte("b")})
+
+	// Keep touching id 1 via Get so it stays most-recently-used while new
+	// entries are Put past the limit.
+	for i := uint64(3); i < 10; i++ {
+		s.Get(uint64(1))
+		s.Put(i, verifier{handle: []byte("x")})
+	}
+
+	if _, ok := s.Get(uint64(1)); !ok {
+		t.Fatalf("Get(1): not found, want the heavily-read entry to have survived eviction")
+	}
+}
+
@@ -0,0 +1,139 @@
+package helpers
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// pathTrieNode is one path component of a pathTrie. ids holds every
+// handle ID whose path is exactly the sequence of components leading to
+// this node.
+type pathTrieNode struct {
+	children map[string]*pathTrieNode
+	ids      map[uuid.UUID]struct{}
+}
+
+// pathTrie indexes handle IDs by the path components of the entry they
+// were minted for, so "every ID whose path is an ancestor of p" (used by
+// CachingHandler.FromHandle to keep ancestor directories' cache entries
+// hot) is a walk of depth len(p) instead of a scan of every live handle.
+type pathTrie struct {
+	mu   sync.Mutex
+	root *pathTrieNode
+}
+
+func newPathTrie() *pathTrie {
+	return &pathTrie{root: newPathTrieNode()}
+}
+
+func newPathTrieNode() *pathTrieNode {
+	return &pathTrieNode{children: make(map[string]*pathTrieNode)}
+}
+
+// Insert records that id refers to path.
+func (t *pathTrie) Insert(path []string, id uuid.UUID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.root
+	for _, part := range path {
+		child, ok := n.children[part]
+		if !ok {
+			child = newPathTrieNode()
+			n.children[part] = child
+		}
+		n = child
+	}
+	if n.ids == nil {
+		n.ids = make(map[uuid.UUID]struct{})
+	}
+	n.ids[id] = struct{}{}
+}
+
+// Remove forgets that id refers to path, and prunes any nodes along path
+// left with no ids and no children.
+func (t *pathTrie) Remove(path []string, id uuid.UUID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.root
+	nodes := []*pathTrieNode{n}
+	for _, part := range path {
+		child, ok := n.children[part]
+		if !ok {
+			return
+		}
+		n = child
+		nodes = append(nodes, n)
+	}
+	delete(n.ids, id)
+	for i := len(path); i > 0; i-- {
+		if len(nodes[i].ids) > 0 || len(nodes[i].children) > 0 {
+			break
+		}
+		delete(nodes[i-1].children, path[i-1])
+	}
+}
+
+// Ancestors returns every ID whose own path is a prefix of path,
+// including path itself - the IDs encountered while walking path down
+// from the root.
+func (t *pathTrie) Ancestors(path []string) []uuid.UUID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.root
+	ids := idsOf(n)
+	for _, part := range path {
+		child, ok := n.children[part]
+		if !ok {
+			break
+		}
+		n = child
+		ids = append(ids, idsOf(n)...)
+	}
+	return ids
+}
+
+func idsOf(n *pathTrieNode) []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(n.ids))
+	for id := range n.ids {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// RemoveSubtree forgets every id recorded at path or at any path nested
+// under it, and returns the ids it forgot, so a caller (CachingHandler,
+// invalidating handles for a removed or renamed-away directory) can also
+// drop them from whatever store backs the trie.
+func (t *pathTrie) RemoveSubtree(path []string) []uuid.UUID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.root
+	var parent *pathTrieNode
+	var lastPart string
+	for _, part := range path {
+		child, ok := n.children[part]
+		if !ok {
+			return nil
+		}
+		parent, lastPart = n, part
+		n = child
+	}
+	ids := collectIDs(n)
+	if parent != nil {
+		delete(parent.children, lastPart)
+	} else {
+		n.children = make(map[string]*pathTrieNode)
+		n.ids = nil
+	}
+	return ids
+}
+
+// collectIDs returns every id in n's subtree, including n's own.
+func collectIDs(n *pathTrieNode) []uuid.UUID {
+	ids := idsOf(n)
+	for _, child := range n.children {
+		ids = append(ids, collectIDs(child)...)
+	}
+	return ids
+}
@@ -0,0 +1,68 @@
+package helpers
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// buildBenchPaths returns n distinct file paths of the form
+// root/dirK/fileI, spread over up to 1000 directories. Only these file
+// paths are inserted, so no path is an ancestor of another: the
+// benchmarks measure the cost of finding a target's ancestors among n
+// live handles, with the target itself as the only match.
+func buildBenchPaths(n int) [][]string {
+	paths := make([][]string, 0, n)
+	for i := 0; i < n; i++ {
+		paths = append(paths, []string{"root", "dir" + strconv.Itoa(i%1000), "file" + strconv.Itoa(i)})
+	}
+	return paths
+}
+
+// naiveAncestors reproduces FromHandle's pre-trie behavior: scan every
+// live (id, path) pair and collect the ones whose path is a prefix of
+// target. This is the O(N) baseline chunk0-4 replaces.
+func naiveAncestors(entries map[uuid.UUID][]string, target []string) []uuid.UUID {
+	var ids []uuid.UUID
+	for id, p := range entries {
+		if hasPrefix(target, p) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func benchmarkNaiveAncestors(b *testing.B, n int) {
+	paths := buildBenchPaths(n)
+	entries := make(map[uuid.UUID][]string, n)
+	for _, p := range paths {
+		entries[uuid.New()] = p
+	}
+	target := paths[len(paths)-1]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		naiveAncestors(entries, target)
+	}
+}
+
+func benchmarkTrieAncestors(b *testing.B, n int) {
+	paths := buildBenchPaths(n)
+	trie := newPathTrie()
+	for _, p := range paths {
+		trie.Insert(p, uuid.New())
+	}
+	target := paths[len(paths)-1]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Ancestors(target)
+	}
+}
+
+func BenchmarkAncestorsNaive1k(b *testing.B)   { benchmarkNaiveAncestors(b, 1_000) }
+func BenchmarkAncestorsNaive100k(b *testing.B) { benchmarkNaiveAncestors(b, 100_000) }
+func BenchmarkAncestorsNaive1M(b *testing.B)   { benchmarkNaiveAncestors(b, 1_000_000) }
+
+func BenchmarkAncestorsTrie1k(b *testing.B)   { benchmarkTrieAncestors(b, 1_000) }
+func BenchmarkAncestorsTrie100k(b *testing.B) { benchmarkTrieAncestors(b, 100_000) }
+func BenchmarkAncestorsTrie1M(b *testing.B)   { benchmarkTrieAncestors(b, 1_000_000) }
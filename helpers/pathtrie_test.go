@@ -0,0 +1,111 @@
+package helpers
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func sortedStrings(ids []uuid.UUID) []string {
+	s := make([]string, 0, len(ids))
+	for _, id := range ids {
+		s = append(s, id.String())
+	}
+	sort.Strings(s)
+	return s
+}
+
+// TestPathTrieAncestors asserts Ancestors returns exactly the ids whose
+// own path is a prefix of the queried path, including the path itself,
+// and nothing from a sibling subtree.
+func TestPathTrieAncestors(t *testing.T) {
+	trie := newPathTrie()
+	root := uuid.New()
+	dir := uuid.New()
+	file := uuid.New()
+	sibling := uuid.New()
+
+	trie.Insert([]string{"root"}, root)
+	trie.Insert([]string{"root", "dir"}, dir)
+	trie.Insert([]string{"root", "dir", "file"}, file)
+	trie.Insert([]string{"root", "other"}, sibling)
+
+	got := sortedStrings(trie.Ancestors([]string{"root", "dir", "file"}))
+	want := sortedStrings([]uuid.UUID{root, dir, file})
+
+	if len(got) != len(want) {
+		t.Fatalf("Ancestors = %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("Ancestors = %v, want %v", got, want)
+		}
+	}
+}
+
+// TestPathTrieRemove asserts a removed id no longer appears in Ancestors.
+func TestPathTrieRemove(t *testing.T) {
+	trie := newPathTrie()
+	id := uuid.New()
+	trie.Insert([]string{"a", "b"}, id)
+	trie.Remove([]string{"a", "b"}, id)
+
+	for _, got := range trie.Ancestors([]string{"a", "b"}) {
+		if got == id {
+			t.Fatalf("Ancestors still returns %v after Remove", id)
+		}
+	}
+}
+
+// TestPathTrieRemoveSubtree asserts RemoveSubtree forgets every id at or
+// under the given path, including deeply nested descendants, but leaves
+// a sibling subtree untouched.
+func TestPathTrieRemoveSubtree(t *testing.T) {
+	trie := newPathTrie()
+	dir := uuid.New()
+	file := uuid.New()
+	nested := uuid.New()
+	sibling := uuid.New()
+
+	trie.Insert([]string{"root", "dir"}, dir)
+	trie.Insert([]string{"root", "dir", "file"}, file)
+	trie.Insert([]string{"root", "dir", "sub", "nested"}, nested)
+	trie.Insert([]string{"root", "sibling"}, sibling)
+
+	removed := sortedStrings(trie.RemoveSubtree([]string{"root", "dir"}))
+	want := sortedStrings([]uuid.UUID{dir, file, nested})
+	if len(removed) != len(want) {
+		t.Fatalf("RemoveSubtree returned %v, want %v", removed, want)
+	}
+	for i := range removed {
+		if removed[i] != want[i] {
+			t.Fatalf("RemoveSubtree returned %v, want %v", removed, want)
+		}
+	}
+
+	for _, got := range trie.Ancestors([]string{"root", "dir", "sub", "nested"}) {
+		if got == dir || got == file || got == nested {
+			t.Fatalf("Ancestors still returns %v after RemoveSubtree", got)
+		}
+	}
+
+	siblingStillPresent := false
+	for _, got := range trie.Ancestors([]string{"root", "sibling"}) {
+		if got == sibling {
+			siblingStillPresent = true
+		}
+	}
+	if !siblingStillPresent {
+		t.Fatalf("RemoveSubtree(root/dir) also removed the unrelated root/sibling entry")
+	}
+}
+
+// TestPathTrieRemoveSubtreeUnknownPath asserts RemoveSubtree on a path
+// that was never Inserted is a no-op rather than panicking.
+func TestPathTrieRemoveSubtreeUnknownPath(t *testing.T) {
+	trie := newPathTrie()
+	if got := trie.RemoveSubtree([]string{"never", "seen"}); got != nil {
+		t.Fatalf("RemoveSubtree(unknown path) = %v, want nil", got)
+	}
+}